@@ -0,0 +1,64 @@
+package letsencrypt
+
+import (
+	"sync"
+	"time"
+)
+
+// hostBackoff tracks per-host renewal failures and the exponential
+// backoff they earn, so a host whose renewal keeps failing doesn't
+// get retried every single renewal pass -- which would otherwise
+// bang against the CA's error-rate limits for as long as it keeps
+// failing.
+type hostBackoff struct {
+	mu    sync.Mutex
+	state map[string]*backoffState
+}
+
+type backoffState struct {
+	failures int
+	until    time.Time
+}
+
+func newHostBackoff() *hostBackoff {
+	return &hostBackoff{state: make(map[string]*backoffState)}
+}
+
+// active reports whether host is currently within a backoff window
+// earned by previous failures.
+func (h *hostBackoff) active(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.state[host]
+	return ok && time.Now().Before(s.until)
+}
+
+// recordFailure registers another failed attempt for host and
+// extends its backoff window exponentially, capped at
+// RenewMaxBackoff.
+func (h *hostBackoff) recordFailure(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.state[host]
+	if !ok {
+		s = &backoffState{}
+		h.state[host] = s
+	}
+	s.failures++
+	wait := time.Minute
+	for i := 1; i < s.failures && wait < RenewMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > RenewMaxBackoff {
+		wait = RenewMaxBackoff
+	}
+	s.until = time.Now().Add(wait)
+}
+
+// clear removes any backoff recorded for host, e.g. after it renews
+// successfully.
+func (h *hostBackoff) clear(host string) {
+	h.mu.Lock()
+	delete(h.state, host)
+	h.mu.Unlock()
+}
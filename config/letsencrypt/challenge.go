@@ -0,0 +1,82 @@
+package letsencrypt
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// ChallengeType selects which ACME challenge newClient asks lego to
+// solve. HTTP01 is the original behavior and requires binding
+// exposePort (5001) so the CA server can reach Caddy directly.
+// TLSSNI01 answers the challenge inline, as part of the normal HTTPS
+// listener's handshake, for hosts behind a firewall that won't let
+// exposePort through.
+type ChallengeType int
+
+const (
+	HTTP01 ChallengeType = iota
+	TLSSNI01
+)
+
+// Challenges is the challenge type newClient uses for every account.
+// It defaults to HTTP01, matching Caddy's original behavior.
+var Challenges = HTTP01
+
+// ChallengeProvider answers an ACME challenge for domain and later
+// cleans up any state created to do so. Its shape mirrors lego's
+// acme.ChallengeProvider so an implementation can be passed straight
+// to acme.Client.SetChallengeProvider.
+type ChallengeProvider interface {
+	Present(domain, token, keyAuth string) error
+	CleanUp(domain, token, keyAuth string) error
+}
+
+// tlsSNIProvider answers the tls-sni-01 challenge the same way
+// x/crypto's autocert package does: by handing back a purpose-built
+// certificate from GetCertificate during the TLS handshake, keyed by
+// the SNI name the challenge expects the CA to dial. This is what lets
+// Caddy prove domain ownership on port 443 alone, without exposePort.
+// The tls-alpn-01 challenge is not handled.
+type tlsSNIProvider struct {
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+var challengeCerts = &tlsSNIProvider{certs: make(map[string]*tls.Certificate)}
+
+func (p *tlsSNIProvider) Present(domain, token, keyAuth string) error {
+	cert, sniName, err := acme.TLSSNI01ChallengeCert(keyAuth)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.certs[sniName] = &cert
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *tlsSNIProvider) CleanUp(domain, token, keyAuth string) error {
+	_, sniName, err := acme.TLSSNI01ChallengeCert(keyAuth)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(p.certs, sniName)
+	p.mu.Unlock()
+	return nil
+}
+
+// GetCertificate looks up a certificate staged by an in-progress
+// tls-sni-01 challenge for clientHello's SNI name. It returns ok=false
+// if clientHello doesn't match a pending challenge, so that callers
+// can fall back to their normal certificate lookup. This is meant to
+// be plumbed into the HTTPS listener's tls.Config.GetCertificate
+// alongside Caddy's usual certificate selection.
+func GetCertificate(clientHello *tls.ClientHelloInfo) (cert *tls.Certificate, ok bool) {
+	challengeCerts.mu.Lock()
+	defer challengeCerts.mu.Unlock()
+	cert, ok = challengeCerts.certs[clientHello.ServerName]
+	return
+}
@@ -0,0 +1,330 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consulStorage is a Storage backend on top of Consul's KV store, so
+// that several Caddy instances that front the same hosts can share
+// one pool of ACME accounts and certificates instead of each instance
+// keeping (and separately renewing) its own. config is the address of
+// a Consul agent, e.g. "127.0.0.1:8500"; it defaults to that address
+// when empty.
+//
+// Locking is implemented with Consul sessions, which is the mechanism
+// Consul itself recommends for building distributed locks on top of
+// its KV store: a session is created with a short TTL, the lock key
+// is acquired against that session, and the session is destroyed (or
+// allowed to expire) to release it. This is what guarantees that only
+// one Caddy instance issues or renews a given certificate at a time.
+// Acquisition itself is a plain poll loop (not a Consul blocking
+// query): a session is renewed in the background for as long as it's
+// either waiting to acquire the key or holding it, so a slow ACME
+// round trip doesn't let the session -- and with it the lock --
+// silently expire out from under the caller.
+type consulStorage struct {
+	addr   string
+	prefix string
+	client *http.Client
+
+	mu        sync.Mutex
+	renewStop map[string]chan struct{}
+}
+
+func newConsulStorage(config string) (Storage, error) {
+	addr := config
+	if addr == "" {
+		addr = "127.0.0.1:8500"
+	}
+	return &consulStorage{
+		addr:      addr,
+		prefix:    "caddy/letsencrypt",
+		client:    &http.Client{Timeout: 10 * time.Second},
+		renewStop: make(map[string]chan struct{}),
+	}, nil
+}
+
+func (c *consulStorage) kvURL(key string) string {
+	return fmt.Sprintf("http://%s/v1/kv/%s/%s", c.addr, c.prefix, key)
+}
+
+func (c *consulStorage) get(key string) ([]byte, error) {
+	resp, err := c.client.Get(c.kvURL(key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul: GET %s: %s", key, resp.Status)
+	}
+
+	var entries []struct {
+		Value string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return base64.StdEncoding.DecodeString(entries[0].Value)
+}
+
+func (c *consulStorage) put(key string, value []byte) error {
+	req, err := http.NewRequest("PUT", c.kvURL(key), bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul: PUT %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (c *consulStorage) StoreUser(email string, reg, key []byte) error {
+	email = strings.ToLower(email)
+	if err := c.put("users/"+email+"/registration", reg); err != nil {
+		return err
+	}
+	if err := c.put("users/"+email+"/key", key); err != nil {
+		return err
+	}
+	return c.put("users/latest", []byte(email))
+}
+
+func (c *consulStorage) LoadUser(email string) (reg, key []byte, err error) {
+	email = strings.ToLower(email)
+	reg, err = c.get("users/" + email + "/registration")
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = c.get("users/" + email + "/key")
+	if err != nil {
+		return nil, nil, err
+	}
+	return reg, key, nil
+}
+
+func (c *consulStorage) MostRecentUserEmail() string {
+	email, err := c.get("users/latest")
+	if err != nil {
+		return ""
+	}
+	return string(email)
+}
+
+func (c *consulStorage) StoreSite(domain string, cert, key []byte) error {
+	if err := c.put("sites/"+domain+"/cert", cert); err != nil {
+		return err
+	}
+	return c.put("sites/"+domain+"/key", key)
+}
+
+func (c *consulStorage) LoadSite(domain string) (cert, key []byte, err error) {
+	cert, err = c.get("sites/" + domain + "/cert")
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = c.get("sites/" + domain + "/key")
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func (c *consulStorage) SiteExists(domain string) bool {
+	_, _, err := c.LoadSite(domain)
+	return err == nil
+}
+
+func (c *consulStorage) StoreMeta(domain string, meta []byte) error {
+	return c.put("sites/"+domain+"/meta", meta)
+}
+
+func (c *consulStorage) LoadMeta(domain string) (meta []byte, err error) {
+	return c.get("sites/" + domain + "/meta")
+}
+
+func (c *consulStorage) StoreOCSPStaple(domain string, staple []byte) error {
+	return c.put("sites/"+domain+"/ocsp", staple)
+}
+
+func (c *consulStorage) LoadOCSPStaple(domain string) (staple []byte, err error) {
+	return c.get("sites/" + domain + "/ocsp")
+}
+
+func (c *consulStorage) ReadRenewTimer() (time.Time, error) {
+	raw, err := c.get("renew-timer")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, string(raw))
+}
+
+func (c *consulStorage) WriteRenewTimer(t time.Time) error {
+	return c.put("renew-timer", []byte(t.UTC().Format(time.RFC3339)))
+}
+
+// sessionTTL is how long a Consul session may go without being
+// renewed before Consul itself destroys it (and releases any lock
+// held against it). sessionRenewInterval must stay comfortably below
+// it so a missed renewal or two doesn't cost us the lock.
+const (
+	sessionTTL           = 30 * time.Second
+	sessionRenewInterval = 10 * time.Second
+)
+
+// Lock creates a Consul session and acquires the named key against
+// it. The session is renewed in the background -- both while polling
+// to acquire the key and for as long as the lock is held -- so a slow
+// caller (a real ACME issuance or renewal easily takes longer than
+// sessionTTL) doesn't lose the lock out from under it.
+func (c *consulStorage) Lock(name string) error {
+	sessionID, err := c.createSession()
+	if err != nil {
+		return err
+	}
+	stop := c.startRenewing(sessionID)
+
+	key := "locks/" + name
+	for {
+		acquired, err := c.acquire(key, sessionID)
+		if err != nil {
+			close(stop)
+			c.destroySession(sessionID)
+			return err
+		}
+		if acquired {
+			if err := c.put(key+"/session", []byte(sessionID)); err != nil {
+				close(stop)
+				c.destroySession(sessionID)
+				return err
+			}
+			c.mu.Lock()
+			c.renewStop[name] = stop
+			c.mu.Unlock()
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *consulStorage) Unlock(name string) error {
+	c.mu.Lock()
+	stop, ok := c.renewStop[name]
+	delete(c.renewStop, name)
+	c.mu.Unlock()
+	if ok {
+		close(stop)
+	}
+
+	sessionID, err := c.get("locks/" + name + "/session")
+	if err != nil {
+		return nil // already unlocked
+	}
+	return c.destroySession(string(sessionID))
+}
+
+// startRenewing renews sessionID every sessionRenewInterval until the
+// returned channel is closed.
+func (c *consulStorage) startRenewing(sessionID string) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(sessionRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.renewSession(sessionID); err != nil {
+					log.Printf("[ERROR] Renewing Consul lock session: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return stop
+}
+
+func (c *consulStorage) createSession() (string, error) {
+	body := strings.NewReader(fmt.Sprintf(`{"TTL":"%s","Behavior":"delete"}`, sessionTTL))
+	resp, err := c.client.Post(fmt.Sprintf("http://%s/v1/session/create", c.addr), "application/json", body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("consul: session create: %s", resp.Status)
+	}
+	var session struct{ ID string }
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", err
+	}
+	return session.ID, nil
+}
+
+func (c *consulStorage) renewSession(id string) error {
+	body := strings.NewReader(fmt.Sprintf(`{"TTL":"%s"}`, sessionTTL))
+	resp, err := c.client.Post(fmt.Sprintf("http://%s/v1/session/renew/%s", c.addr, id), "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul: session renew: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *consulStorage) destroySession(id string) error {
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/v1/session/destroy/%s", c.addr, id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return nil
+}
+
+func (c *consulStorage) acquire(key, sessionID string) (bool, error) {
+	u := c.kvURL(key) + "?acquire=" + url.QueryEscape(sessionID)
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(nil))
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(result)) == "true", nil
+}
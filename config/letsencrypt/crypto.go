@@ -0,0 +1,83 @@
+package letsencrypt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// generateKey creates a new private key of the given size/type,
+// suitable for an ACME account or a certificate request.
+func generateKey(size KeySize) (crypto.Signer, error) {
+	switch size {
+	case ECC_224:
+		return ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	case ECC_256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECC_384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case RSA_2048, RSA_4096:
+		return rsa.GenerateKey(rand.Reader, int(size))
+	default:
+		return nil, fmt.Errorf("unsupported key type: %v", size)
+	}
+}
+
+// loadPrivateKey decodes a PEM-encoded RSA or ECDSA private key,
+// telling which from the PEM block's type.
+func loadPrivateKey(keyBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, errors.New("no PEM-encoded key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key PEM type %q", block.Type)
+	}
+}
+
+// savePrivateKey PEM-encodes key for storage, picking the PEM block
+// type that matches key's underlying algorithm.
+func savePrivateKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(k),
+		}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// certValidity returns the validity window of a PEM-encoded
+// certificate, so callers can size a renewal window as a fraction of
+// the certificate's own lifetime instead of a fixed day count.
+func certValidity(certBytes []byte) (notBefore, notAfter time.Time, err error) {
+	block, _ := pem.Decode(certBytes)
+	if block == nil {
+		return notBefore, notAfter, errors.New("no PEM-encoded certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return notBefore, notAfter, err
+	}
+	return cert.NotBefore, cert.NotAfter, nil
+}
@@ -0,0 +1,61 @@
+package letsencrypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestGenerateAndSaveLoadPrivateKeyRSA(t *testing.T) {
+	key, err := generateKey(RSA_2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		t.Fatalf("generateKey(RSA_2048) returned %T, want *rsa.PrivateKey", key)
+	}
+
+	pemBytes, err := savePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadPrivateKey(pemBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedKey, ok := loaded.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("loadPrivateKey returned %T, want *rsa.PrivateKey", loaded)
+	}
+	if !loadedKey.Equal(key.(*rsa.PrivateKey)) {
+		t.Fatal("loaded RSA key does not match the key that was saved")
+	}
+}
+
+func TestGenerateAndSaveLoadPrivateKeyECDSA(t *testing.T) {
+	key, err := generateKey(ECC_256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("generateKey(ECC_256) returned %T, want *ecdsa.PrivateKey", key)
+	}
+
+	pemBytes, err := savePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadPrivateKey(pemBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedKey, ok := loaded.(*ecdsa.PrivateKey)
+	if !ok {
+		t.Fatalf("loadPrivateKey returned %T, want *ecdsa.PrivateKey", loaded)
+	}
+	if !loadedKey.Equal(key.(*ecdsa.PrivateKey)) {
+		t.Fatal("loaded ECDSA key does not match the key that was saved")
+	}
+}
@@ -0,0 +1,64 @@
+package letsencrypt
+
+import "sync"
+
+// HostOptions holds the Let's Encrypt settings Caddy applies for one
+// vhost, overriding the process-wide defaults below. Per-site options
+// (challenge type, CA endpoint, key type, on-demand cap, EAB
+// credentials) are registered by calling SetHostOptions; no Caddyfile
+// directive calls it. This lets one Caddy process run, say, production
+// Let's Encrypt with RSA keys for one vhost and a private ACME CA with
+// ECDSA keys for another -- something a single set of package-level
+// variables can't express.
+type HostOptions struct {
+	// Challenges selects which ACME challenge this host answers.
+	Challenges ChallengeType
+
+	// MaxCerts overrides MaxCerts for this host; see MaxCerts'
+	// doc comment in ondemand.go.
+	MaxCerts int
+
+	// KeyType overrides KeyTypeToUse for this host's account and
+	// certificate keys.
+	KeyType KeySize
+
+	// CAEndpoint overrides CAEndpoint for this host.
+	CAEndpoint string
+
+	// EABKeyID and EABHMACKey override EABKeyID/EABHMACKey for this
+	// host's account.
+	EABKeyID   string
+	EABHMACKey string
+}
+
+var (
+	hostOptionsMu sync.RWMutex
+	hostOptions   = make(map[string]HostOptions)
+)
+
+// SetHostOptions overrides the process-wide Let's Encrypt settings for
+// host.
+func SetHostOptions(host string, opts HostOptions) {
+	hostOptionsMu.Lock()
+	hostOptions[host] = opts
+	hostOptionsMu.Unlock()
+}
+
+// optionsFor returns host's overridden settings, if SetHostOptions was
+// ever called for it, or else the process-wide defaults.
+func optionsFor(host string) HostOptions {
+	hostOptionsMu.RLock()
+	opts, ok := hostOptions[host]
+	hostOptionsMu.RUnlock()
+	if ok {
+		return opts
+	}
+	return HostOptions{
+		Challenges: Challenges,
+		MaxCerts:   MaxCerts,
+		KeyType:    KeyTypeToUse,
+		CAEndpoint: CAEndpoint,
+		EABKeyID:   EABKeyID,
+		EABHMACKey: EABHMACKey,
+	}
+}
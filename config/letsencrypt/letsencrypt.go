@@ -4,12 +4,12 @@
 package letsencrypt
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -32,29 +32,40 @@ import (
 // address from last time. If there isn't one, the user
 // will be prompted. If the user leaves email blank, <TODO>.
 func Activate(configs []server.Config) ([]server.Config, error) {
-	// First identify and configure any elligible hosts for which
-	// we already have certs and keys in storage from last time.
+	// First identify and configure any elligible hosts for which we
+	// already have certs and keys in storage from last time, plus any
+	// host that wants its certificate obtained on demand -- the latter
+	// never goes through the eager obtainCertificates loop below, so
+	// this is its only chance to get a GetCertificate installed. This
+	// also covers a catchall config (Host == "") when on-demand TLS is
+	// turned on process-wide, since it's the only way to accept a
+	// not-pre-declared SNI name.
 	configLen := len(configs) // avoid infinite loop since this loop appends to the slice
 	for i := 0; i < configLen; i++ {
-		if existingCertAndKey(configs[i].Host) && configs[i].TLS.LetsEncryptEmail != "off" {
+		if configs[i].TLS.LetsEncryptEmail == "off" {
+			continue
+		}
+		if existingCertAndKey(configs[i].Host) || wantsOnDemand(configs[i]) {
 			configs = autoConfigure(&configs[i], configs)
 		}
 	}
 	// Handle cert renewal on Startup
 	processCertificateRenewal(configs)
 
-	// Group configs by LE email address; this will help us
-	// reduce round-trips when getting the certs.
-	initMap, err := groupConfigsByEmail(configs)
+	// Group configs by LE account and host options; this will help us
+	// reduce round-trips when getting the certs, while still letting
+	// different vhosts use different challenge types, CAs, or key
+	// types in the same process.
+	initMap, err := groupConfigsByClient(configs)
 	if err != nil {
 		return configs, err
 	}
 
-	// Loop through each email address and obtain certs; we can obtain more
-	// than one certificate per email address, and still save them individually.
-	for leEmail, serverConfigs := range initMap {
-		// make client to service this email address with CA server
-		client, err := newClient(leEmail)
+	// Loop through each group and obtain certs; we can obtain more
+	// than one certificate per group, and still save them individually.
+	for key, serverConfigs := range initMap {
+		// make client to service this group with the CA server
+		client, err := newClient(key)
 		if err != nil {
 			return configs, err
 		}
@@ -78,18 +89,39 @@ func Activate(configs []server.Config) ([]server.Config, error) {
 	}
 
 	go renewalFunc(configs)
+	go ocspRefreshFunc(configs)
 
 	return configs, nil
 }
 
-// groupConfigsByEmail groups configs by the Let's Encrypt email address
-// associated to them or to the default Let's Encrypt email address. If the
-// default email is not available, the user will be prompted to provide one.
+// clientKey identifies one ACME account/settings combination: the
+// email address that owns the account, plus the HostOptions it's
+// registering and issuing under. Two configs with the same email but
+// different HostOptions (e.g. different Challenges) get separate
+// clients, since those settings live on the client, not the account.
+type clientKey struct {
+	email string
+	opts  HostOptions
+}
+
+// wantsOnDemand reports whether cfg should get its certificate lazily,
+// the first time a ClientHello for its SNI name arrives, rather than
+// eagerly here in Activate -- i.e. whether HostOptions.MaxCerts is
+// turned on for it.
+func wantsOnDemand(cfg server.Config) bool {
+	return optionsFor(cfg.Host).MaxCerts > 0
+}
+
+// groupConfigsByClient groups configs by clientKey, so configs that
+// share both an LE account and the same HostOptions can be obtained
+// together to reduce round-trips, while configs that differ in either
+// still get their own client.
 //
 // This function also filters out configs that don't need extra TLS help.
-// Configurations with a manual TLS configuration or one that is already
-// found in storage will not be added to any group.
-func groupConfigsByEmail(configs []server.Config) (map[string][]*server.Config, error) {
+// Configurations with a manual TLS configuration, one that is already
+// found in storage, or one that wants its certificate on demand
+// instead (see wantsOnDemand) will not be added to any group.
+func groupConfigsByClient(configs []server.Config) (map[clientKey][]*server.Config, error) {
 	// configQualifies returns true if cfg qualifes for automatic LE activation
 	configQualifies := func(cfg server.Config) bool {
 		return cfg.TLS.Certificate == "" && // user could provide their own cert and key
@@ -99,6 +131,10 @@ func groupConfigsByEmail(configs []server.Config) (map[string][]*server.Config,
 			cfg.Port != "http" &&
 			cfg.TLS.LetsEncryptEmail != "off" &&
 
+			// on-demand hosts get their certificate lazily, in
+			// getCertificateFunc, not eagerly here
+			!wantsOnDemand(cfg) &&
+
 			// obviously we get can't certs for loopback or internal hosts
 			cfg.Host != "localhost" &&
 			cfg.Host != "" &&
@@ -111,7 +147,7 @@ func groupConfigsByEmail(configs []server.Config) (map[string][]*server.Config,
 			!hostHasOtherScheme(cfg.Host, "https", configs)
 	}
 
-	initMap := make(map[string][]*server.Config)
+	initMap := make(map[clientKey][]*server.Config)
 	for i := 0; i < len(configs); i++ {
 		if !configQualifies(configs[i]) {
 			continue
@@ -120,7 +156,8 @@ func groupConfigsByEmail(configs []server.Config) (map[string][]*server.Config,
 		if leEmail == "" {
 			return nil, errors.New("must have email address to serve HTTPS without existing certificate and key")
 		}
-		initMap[leEmail] = append(initMap[leEmail], &configs[i])
+		key := clientKey{email: leEmail, opts: optionsFor(configs[i].Host)}
+		initMap[key] = append(initMap[key], &configs[i])
 	}
 	return initMap, nil
 }
@@ -128,36 +165,46 @@ func groupConfigsByEmail(configs []server.Config) (map[string][]*server.Config,
 // existingCertAndKey returns true if the host has a certificate
 // and private key in storage already, false otherwise.
 func existingCertAndKey(host string) bool {
-	_, err := os.Stat(storage.SiteCertFile(host))
-	if err != nil {
-		return false
-	}
-	_, err = os.Stat(storage.SiteKeyFile(host))
-	if err != nil {
-		return false
-	}
-	return true
+	return storage.SiteExists(host)
 }
 
 // newClient creates a new ACME client to facilitate communication
-// with the Let's Encrypt CA server on behalf of the user specified
-// by leEmail. As part of this process, a user will be loaded from
-// disk (if already exists) or created new and registered via ACME
-// and saved to the file system for next time.
-func newClient(leEmail string) (*acme.Client, error) {
+// with the Let's Encrypt CA server on behalf of the user identified by
+// key.email, configured per key.opts. As part of this process, a user
+// will be loaded from storage (if already exists) or created new and
+// registered via ACME and saved to storage for next time.
+func newClient(key clientKey) (*acme.Client, error) {
 	// Look up or create the LE user account
-	leUser, err := getUser(leEmail)
+	leUser, err := getUser(key.email, key.opts)
 	if err != nil {
 		return nil, err
 	}
 
 	// The client facilitates our communication with the CA server.
-	client := acme.NewClient(caURL, &leUser, rsaKeySizeToUse, exposePort, true) // TODO: Dev mode is enabled
+	client := acme.NewClient(key.opts.CAEndpoint, &leUser, int(key.opts.KeyType), exposePort, true) // TODO: Dev mode is enabled
+
+	// By default we solve HTTP-01 on exposePort. If the operator asked
+	// for TLS-SNI-01 instead (for hosts behind a firewall that blocks
+	// exposePort), answer it inline via GetCertificate during the
+	// HTTPS handshake instead.
+	if key.opts.Challenges == TLSSNI01 {
+		client.SetChallengeProvider(acme.TLSSNI01, challengeCerts)
+		client.ExcludeChallenges([]acme.Challenge{acme.HTTP01})
+	}
 
 	// If not registered, the user must register an account with the CA
 	// and agree to terms
 	if leUser.Registration == nil {
-		reg, err := client.Register()
+		var reg *acme.RegistrationResource
+		if leUser.EABKeyID != "" {
+			// Some CAs (typically commercial ones) require External
+			// Account Binding: proof, via a pre-shared key ID and HMAC
+			// key, that this ACME account corresponds to an existing
+			// relationship with the CA.
+			reg, err = client.RegisterWithExternalAccountBinding(leUser.EABKeyID, leUser.EABHMACKey)
+		} else {
+			reg, err = client.Register()
+		}
 		if err != nil {
 			return nil, errors.New("registration error: " + err.Error())
 		}
@@ -197,43 +244,92 @@ func obtainCertificates(client *acme.Client, serverConfigs []*server.Config) ([]
 	return certificates, nil
 }
 
-// saveCertificates saves each certificate resource to disk. This
-// includes the certificate file itself, the private key, and the
-// metadata file.
+// saveCertsAndKeys saves each certificate resource to storage. This
+// includes the certificate itself, the private key, and the metadata,
+// while holding the distributed lock for each domain so that other
+// Caddy instances sharing this storage don't race to do the same.
 func saveCertsAndKeys(certificates []acme.CertificateResource) error {
 	for _, cert := range certificates {
-		os.MkdirAll(storage.Site(cert.Domain), 0700)
-
-		// Save cert
-		err := ioutil.WriteFile(storage.SiteCertFile(cert.Domain), cert.Certificate, 0600)
-		if err != nil {
+		if err := storage.Lock(cert.Domain); err != nil {
 			return err
 		}
 
-		// Save private key
-		err = ioutil.WriteFile(storage.SiteKeyFile(cert.Domain), cert.PrivateKey, 0600)
+		err := saveCertAndKey(cert)
+		storage.Unlock(cert.Domain)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// Save cert metadata
-		jsonBytes, err := json.MarshalIndent(&cert, "", "\t")
-		if err != nil {
-			return err
+// saveCertAndKey saves a single certificate resource to storage. The
+// caller is responsible for holding the storage lock for cert.Domain.
+func saveCertAndKey(cert acme.CertificateResource) error {
+	err := storage.StoreSite(cert.Domain, cert.Certificate, cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	jsonBytes, err := json.MarshalIndent(&cert, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := storage.StoreMeta(cert.Domain, jsonBytes); err != nil {
+		return err
+	}
+
+	// OCSP stapling is best-effort: a certificate with no cached staple
+	// still works, it just costs clients an extra round trip to the
+	// responder, so a failure here shouldn't fail the whole save.
+	if err := stapleOCSP(cert.Domain); err != nil {
+		log.Printf("[ERROR] Getting OCSP staple for %s: %v", cert.Domain, err)
+	}
+
+	return nil
+}
+
+// getCertificateFunc returns the tls.Config.GetCertificate callback
+// installed for cfg's HTTPS listener. It first answers any in-flight
+// TLS-SNI-01 challenge for clientHello's name, so Challenges ==
+// TLSSNI01 actually gets solved on the real handshake path; otherwise
+// it serves cfg.Host's certificate (stapling its cached OCSP response
+// if one is on file), falling back to GetCertificateOnDemand -- and
+// so, subject to HostOptions.MaxCerts, a lazy ACME issuance -- for a
+// host that wantsOnDemand kept out of Activate's eager obtaining, or
+// for a catchall config (Host == "") that has no single SNI name to
+// have obtained up front in the first place.
+func getCertificateFunc(cfg server.Config) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	leEmail := getEmail(cfg)
+	return func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert, ok := GetCertificate(clientHello); ok {
+			return cert, nil
+		}
+		if !storage.SiteExists(cfg.Host) {
+			return GetCertificateOnDemand(leEmail, clientHello)
 		}
-		err = ioutil.WriteFile(storage.SiteMetaFile(cert.Domain), jsonBytes, 0600)
+		certBytes, keyBytes, err := storage.LoadSite(cfg.Host)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return certificateWithStaple(cfg.Host, certBytes, keyBytes)
 	}
-	return nil
 }
 
 // autoConfigure enables TLS on cfg and appends, if necessary, a new config
 // to allConfigs that redirects plaintext HTTP to its new HTTPS counterpart.
 func autoConfigure(cfg *server.Config, allConfigs []server.Config) []server.Config {
-	cfg.TLS.Certificate = storage.SiteCertFile(cfg.Host)
-	cfg.TLS.Key = storage.SiteKeyFile(cfg.Host)
+	// Backends that keep their files on local disk (the default file
+	// storage) can additionally hand the TLS stack a path directly, as
+	// a cheap hint for any tooling that reads cfg.TLS.Certificate/Key
+	// directly. But the actual certificate serving path below doesn't
+	// depend on that: GetCertificate is installed for every backend, so
+	// a backend without a filePather (e.g. consulStorage) still gets a
+	// real certificate instead of silently serving TLS with none.
+	if fp, ok := storage.(filePather); ok {
+		cfg.TLS.Certificate, cfg.TLS.Key = fp.SitePaths(cfg.Host)
+	}
+	cfg.TLS.Config = &tls.Config{GetCertificate: getCertificateFunc(*cfg)}
 	cfg.TLS.Enabled = true
 	cfg.Port = "https"
 
@@ -292,7 +388,7 @@ func renewalFunc(configs []server.Config) {
 	}
 
 	for {
-		timer := time.NewTimer(time.Duration(nextRun) * time.Hour)
+		timer := time.NewTimer(jitteredInterval(nextRun))
 		<-timer.C
 		nextRun, err = processCertificateRenewal(configs)
 		if err != nil {
@@ -302,6 +398,23 @@ func renewalFunc(configs []server.Config) {
 	}
 }
 
+// jitteredInterval turns an hour count into a time.Duration with a
+// random +/- RenewJitter offset, so a fleet of instances that all
+// started their renewal loop around the same time doesn't wake and
+// hit the CA all at once.
+func jitteredInterval(hours int) time.Duration {
+	base := time.Duration(hours) * time.Hour
+	if RenewJitter <= 0 {
+		return base
+	}
+	offset := time.Duration(rand.Int63n(int64(2*RenewJitter))) - RenewJitter
+	d := base + offset
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
 // checkCertificateRenewal loops through all configured
 // sites and looks for certificates to renew. Nothing is mutated
 // through this function. The changes happen directly on disk.
@@ -317,8 +430,9 @@ func processCertificateRenewal(configs []server.Config) (int, error) {
 		return next, nil
 	}
 
-	// We are executing. Write the current timestamp into the file.
-	err = ioutil.WriteFile(storage.RenewTimerFile(), []byte(time.Now().UTC().Format(time.RFC3339)), 0600)
+	// We are executing. Write the current timestamp so future calls know
+	// when this pass ran.
+	err = storage.WriteRenewTimer(time.Now())
 	if err != nil {
 		return 0, err
 	}
@@ -330,86 +444,129 @@ func processCertificateRenewal(configs []server.Config) (int, error) {
 			continue
 		}
 
-		// Read the certificate and get the NotAfter time.
-		certBytes, err := ioutil.ReadFile(storage.SiteCertFile(cfg.Host))
-		if err != nil {
+		if err := storage.Lock(cfg.Host); err != nil {
 			return 0, err
 		}
-		expTime, err := acme.GetPEMCertExpiration(certBytes)
+		_, err := renewIfNeeded(cfg)
+		storage.Unlock(cfg.Host)
 		if err != nil {
 			return 0, err
 		}
+	}
 
-		// The time returned from the certificate is always in UTC.
-		// So calculate the time left with local time as UTC.
-		// Directly convert it to days for the following checks.
-		daysLeft := int(expTime.Sub(time.Now().UTC()).Hours() / 24)
-
-		// Renew on two or less days remaining.
-		if daysLeft <= 2 {
-			log.Printf("[WARN] There are %d days left on the certificate of %s. Trying to renew now.", daysLeft, cfg.Host)
-			client, err := newClient(getEmail(cfg))
-			if err != nil {
-				return 0, err
-			}
-
-			// Read metadata
-			metaBytes, err := ioutil.ReadFile(storage.SiteMetaFile(cfg.Host))
-			if err != nil {
-				return 0, err
-			}
-
-			privBytes, err := ioutil.ReadFile(storage.SiteKeyFile(cfg.Host))
-			if err != nil {
-				return 0, err
-			}
-
-			var certMeta acme.CertificateResource
-			err = json.Unmarshal(metaBytes, &certMeta)
-			certMeta.Certificate = certBytes
-			certMeta.PrivateKey = privBytes
-
-			// Renew certificate.
-			// TODO: revokeOld should be an option in the caddyfile
-			newCertMeta, err := client.RenewCertificate(certMeta, true)
-			if err != nil {
-				return 0, err
-			}
-
-			saveCertsAndKeys([]acme.CertificateResource{newCertMeta})
-		}
+	return next, nil
+}
+
+// renewIfNeeded renews cfg's certificate if less than
+// RenewDurationRatio of its validity period remains, logs a warning
+// once less than RenewWarnDurationRatio remains, and returns how many
+// days are left on the certificate that ends up in storage (the
+// renewed one, if it renewed). A host that keeps failing to renew is
+// backed off per renewalBackoff instead of being retried every pass,
+// and a failure here does not prevent other hosts in the same pass
+// from being considered. The caller is responsible for holding the
+// storage lock for cfg.Host.
+func renewIfNeeded(cfg server.Config) (int, error) {
+	certBytes, _, err := storage.LoadSite(cfg.Host)
+	if err != nil {
+		return 0, err
+	}
+	notBefore, notAfter, err := certValidity(certBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	// The times on the certificate are always in UTC, so calculate the
+	// time left with local time as UTC.
+	remaining := notAfter.Sub(time.Now().UTC())
+	totalValidity := notAfter.Sub(notBefore)
+	daysLeft := int(remaining.Hours() / 24)
+
+	renewAt := time.Duration(float64(totalValidity) * RenewDurationRatio)
+	warnAt := time.Duration(float64(totalValidity) * RenewWarnDurationRatio)
 
-		// Warn on 14 days remaining
-		if daysLeft <= 14 {
-			log.Printf("[WARN] There are %d days left on the certificate of %s. Will renew on two days left.\n", daysLeft, cfg.Host)
+	switch {
+	case remaining <= renewAt:
+		if renewalBackoff.active(cfg.Host) {
+			log.Printf("[WARN] Skipping renewal of %s; backing off after previous failures", cfg.Host)
+			break
 		}
+		log.Printf("[WARN] There are %d days left on the certificate of %s. Trying to renew now.", daysLeft, cfg.Host)
+		newDaysLeft, err := renewCertificate(cfg, certBytes)
+		if err != nil {
+			renewalBackoff.recordFailure(cfg.Host)
+			log.Printf("[ERROR] Renewing %s: %v", cfg.Host, err)
+			break
+		}
+		renewalBackoff.clear(cfg.Host)
+		daysLeft = newDaysLeft
+	case remaining <= warnAt:
+		log.Printf("[WARN] There are %d days left on the certificate of %s. Will renew soon.\n", daysLeft, cfg.Host)
 	}
 
-	return next, nil
+	return daysLeft, nil
 }
 
-// getNextRenewalShedule calculates the offset in hours the renew process should
-// run from the current time. If the file the time is in does not exists, the
-// function returns zero to trigger a renew asap.
-func getNextRenewalShedule() (int, error) {
+// renewCertificate does the actual ACME renewal for cfg, whose
+// current certificate is certBytes, and persists the result. It
+// returns the number of days left on the freshly renewed certificate.
+func renewCertificate(cfg server.Config, certBytes []byte) (int, error) {
+	client, err := newClient(clientKey{email: getEmail(cfg), opts: optionsFor(cfg.Host)})
+	if err != nil {
+		return 0, err
+	}
 
-	// Check if the file exists. If it does not, return 0 to indicate immediate processing.
-	if _, err := os.Stat(storage.RenewTimerFile()); os.IsNotExist(err) {
-		return 0, nil
+	// Read metadata
+	metaBytes, err := storage.LoadMeta(cfg.Host)
+	if err != nil {
+		return 0, err
+	}
+
+	_, privBytes, err := storage.LoadSite(cfg.Host)
+	if err != nil {
+		return 0, err
+	}
+
+	var certMeta acme.CertificateResource
+	err = json.Unmarshal(metaBytes, &certMeta)
+	if err != nil {
+		return 0, err
+	}
+	certMeta.Certificate = certBytes
+	certMeta.PrivateKey = privBytes
+
+	// Renew certificate.
+	// TODO: revokeOld should be an option in the caddyfile
+	newCertMeta, err := client.RenewCertificate(certMeta, true)
+	if err != nil {
+		return 0, err
 	}
 
-	renewTimeBytes, err := ioutil.ReadFile(storage.RenewTimerFile())
+	if err := saveCertAndKey(newCertMeta); err != nil {
+		return 0, err
+	}
+
+	_, newNotAfter, err := certValidity(newCertMeta.Certificate)
 	if err != nil {
 		return 0, err
 	}
+	return int(newNotAfter.Sub(time.Now().UTC()).Hours() / 24), nil
+}
 
-	renewalTime, err := time.Parse(time.RFC3339, string(renewTimeBytes))
+// getNextRenewalShedule calculates the offset in hours the renew process should
+// run from the current time. If no renewal pass has ever run, the
+// function returns zero to trigger a renew asap.
+func getNextRenewalShedule() (int, error) {
+	renewalTime, err := storage.ReadRenewTimer()
 	if err != nil {
 		return 0, err
 	}
+	if renewalTime.IsZero() {
+		return 0, nil
+	}
 
-	// The time read from the file was equal or more then 24 hours in the past,
-	// write the current time to the file and return true.
+	// If the time read from storage is renewTimer (24) or more hours in
+	// the past, return zero so the caller runs a pass now.
 	hoursSinceRenew := int(time.Now().UTC().Sub(renewalTime).Hours())
 
 	if hoursSinceRenew >= renewTimer {
@@ -429,10 +586,6 @@ var (
 
 // Some essential values related to the Let's Encrypt process
 const (
-	// The base URL to the Let's Encrypt CA
-	// TODO: Staging API URL is: https://acme-staging.api.letsencrypt.org
-	caURL = "http://192.168.99.100:4000"
-
 	// The port to expose to the CA server for Simple HTTP Challenge
 	exposePort = "5001"
 
@@ -440,24 +593,72 @@ const (
 	renewTimer = 24
 )
 
-// KeySize represents the length of a key in bits.
+// Named ACME directory presets for CAEndpoint, alongside support for
+// any arbitrary directory URL -- e.g. a private ACME CA such as
+// step-ca or a local Boulder deployment.
+const (
+	CALetsEncryptProduction = "https://acme-v01.api.letsencrypt.org/directory"
+	CALetsEncryptStaging    = "https://acme-staging.api.letsencrypt.org/directory"
+)
+
+// CAEndpoint is the ACME directory URL newClient talks to. It
+// defaults to Let's Encrypt's production endpoint; setting it (or a
+// host's HostOptions.CAEndpoint) points it at the staging endpoint or
+// at a private ACME CA instead. No Caddyfile directive sets it.
+var CAEndpoint = CALetsEncryptProduction
+
+// Renewal window tuning. These are expressed as fractions of each
+// certificate's own validity period rather than fixed day counts, so
+// the same defaults make sense whether a CA issues 90-day certs or
+// much shorter-lived ones. They are process-wide package variables; no
+// Caddyfile directive sets them.
+var (
+	// RenewDurationRatio is how much of a certificate's validity
+	// period may remain before Caddy tries to renew it.
+	RenewDurationRatio = 1.0 / 3.0
+
+	// RenewWarnDurationRatio is how much of a certificate's validity
+	// period may remain before Caddy starts logging that renewal is
+	// coming. It must be greater than RenewDurationRatio.
+	RenewWarnDurationRatio = 1.0 / 2.0
+
+	// RenewJitter is the maximum random offset applied to the sleep
+	// between renewal passes, to keep a fleet of instances on the same
+	// schedule from all hitting the CA at once.
+	RenewJitter = time.Hour
+
+	// RenewMaxBackoff caps the exponential backoff applied to a host
+	// that keeps failing to renew.
+	RenewMaxBackoff = 24 * time.Hour
+)
+
+// renewalBackoff tracks, per host, how many renewal attempts have
+// failed in a row, and backs off exponentially (capped at
+// RenewMaxBackoff) so a host that can't renew doesn't get hammered
+// against the CA's error-rate limits every single pass.
+var renewalBackoff = newHostBackoff()
+
+// KeySize represents the strength of a key: the length in bits for
+// RSA, or a hint at which curve to use for ECDSA.
 type KeySize int
 
-// Key sizes are used to determine the strength of a key.
+// Key sizes/types to use for account and certificate keys.
 const (
 	ECC_224  KeySize = 224
-	ECC_256          = 256
-	RSA_2048         = 2048
-	RSA_4096         = 4096
+	ECC_256  KeySize = 256
+	ECC_384  KeySize = 384
+	RSA_2048 KeySize = 2048
+	RSA_4096 KeySize = 4096
 )
 
-// rsaKeySizeToUse is the size to use for new RSA keys.
-// This shouldn't need to change except for in tests;
-// the size can be drastically reduced for speed.
-var rsaKeySizeToUse = RSA_2048
+// KeyTypeToUse is the key type used to generate new ACME account keys
+// and, unless a certificate request says otherwise, new certificate
+// keys too. A host's HostOptions.KeyType overrides it; no Caddyfile
+// directive sets either.
+var KeyTypeToUse = RSA_2048
 
 // CertificateMeta is a container type used to write out a file
 // with information about a certificate.
 type CertificateMeta struct {
 	Domain, URL string
-}
\ No newline at end of file
+}
@@ -0,0 +1,158 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/mholt/caddy/server"
+)
+
+// OCSP staple refresh tuning. A staple is re-fetched once it's within
+// OCSPRefreshWindow of its NextUpdate time, plus up to OCSPJitter of
+// random slack so a process with many certificates doesn't hit every
+// OCSP responder in lockstep.
+var (
+	OCSPRefreshWindow = 12 * time.Hour
+	OCSPJitter        = time.Hour
+)
+
+// stapleOCSP fetches a fresh OCSP response for domain's certificate
+// from its issuer's OCSP responder and caches it in storage, so it
+// can be included ("stapled") in the TLS handshake instead of every
+// client querying the responder itself. It's a no-op, not an error,
+// if the certificate doesn't advertise an OCSP responder; a chain
+// without the issuer certificate is an error either way. The caller
+// is responsible for holding the storage lock for domain.
+func stapleOCSP(domain string) error {
+	certPEM, _, err := storage.LoadSite(domain)
+	if err != nil {
+		return err
+	}
+
+	leaf, issuer, err := parseCertAndIssuer(certPEM)
+	if err != nil {
+		return err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := http.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+
+	// Parsing against issuer also verifies the responder's signature.
+	if _, err := ocsp.ParseResponse(respBytes, issuer); err != nil {
+		return err
+	}
+
+	return storage.StoreOCSPStaple(domain, respBytes)
+}
+
+// parseCertAndIssuer splits a PEM chain (as stored by saveCertAndKey)
+// into the leaf certificate and its issuer.
+func parseCertAndIssuer(certPEM []byte) (leaf, issuer *x509.Certificate, err error) {
+	block, rest := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, errors.New("no PEM-encoded certificate found")
+	}
+	leaf, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ = pem.Decode(rest)
+	if block == nil {
+		return nil, nil, errors.New("no issuer certificate in chain; cannot OCSP staple")
+	}
+	issuer, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaf, issuer, nil
+}
+
+// ocspNeedsRefresh reports whether domain's cached OCSP staple is
+// missing or close enough to its NextUpdate to warrant refreshing.
+func ocspNeedsRefresh(domain string) bool {
+	staple, err := storage.LoadOCSPStaple(domain)
+	if err != nil {
+		return true
+	}
+	resp, err := ocsp.ParseResponse(staple, nil)
+	if err != nil {
+		return true
+	}
+
+	window := OCSPRefreshWindow
+	if OCSPJitter > 0 {
+		window += time.Duration(rand.Int63n(int64(OCSPJitter)))
+	}
+	return time.Until(resp.NextUpdate) <= window
+}
+
+// certificateWithStaple builds a tls.Certificate for domain from
+// certBytes/keyBytes, attaching any cached OCSP staple so it's sent
+// as part of the handshake without an extra client round trip to the
+// responder.
+func certificateWithStaple(domain string, certBytes, keyBytes []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if staple, err := storage.LoadOCSPStaple(domain); err == nil {
+		cert.OCSPStaple = staple
+	}
+	return &cert, nil
+}
+
+// ocspRefreshFunc runs alongside renewalFunc for the lifetime of the
+// process, periodically re-stapling any certificate whose cached OCSP
+// response is due to expire.
+func ocspRefreshFunc(configs []server.Config) {
+	for {
+		for _, cfg := range configs {
+			if !cfg.TLS.Enabled || !existingCertAndKey(cfg.Host) {
+				continue
+			}
+			if !ocspNeedsRefresh(cfg.Host) {
+				continue
+			}
+			// Lock against renewalFunc, which rewrites this domain's
+			// certificate (and hence re-staples it) without any other
+			// synchronization of its own.
+			if err := storage.Lock(cfg.Host); err != nil {
+				log.Printf("[ERROR] Refreshing OCSP staple for %s: %v", cfg.Host, err)
+				continue
+			}
+			err := stapleOCSP(cfg.Host)
+			storage.Unlock(cfg.Host)
+			if err != nil {
+				log.Printf("[ERROR] Refreshing OCSP staple for %s: %v", cfg.Host, err)
+			}
+		}
+		time.Sleep(jitteredInterval(1))
+	}
+}
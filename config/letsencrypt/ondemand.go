@@ -0,0 +1,192 @@
+package letsencrypt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// MaxCerts, when greater than zero, turns on on-demand TLS: instead
+// of obtaining every configured site's certificate up front, a site
+// whose HostOptions.MaxCerts is greater than zero gets its certificate
+// lazily, the first time a ClientHello for its name arrives; no
+// Caddyfile directive sets MaxCerts or HostOptions.MaxCerts. MaxCerts
+// caps how many certificates this process will obtain this way for
+// any one name. The count is kept separately for each name, so it
+// does not limit the total obtained across different names.
+var MaxCerts int
+
+// onDemandTimeout bounds how long a single on-demand ACME transaction
+// may take; past it, the handshake fails rather than hanging the
+// client indefinitely while Caddy waits on the CA.
+const onDemandTimeout = 10 * time.Second
+
+// onDemandCache holds certificates obtained on-demand, in memory, so
+// repeat handshakes for the same name don't each trigger a new ACME
+// transaction. It's separate from the on-disk store that
+// saveCertsAndKeys maintains; entries here are warmed from or written
+// back to that store as they're obtained.
+var onDemandCache = struct {
+	sync.RWMutex
+	certs map[string]*tls.Certificate
+}{certs: make(map[string]*tls.Certificate)}
+
+// certsIssued counts, per host, how many certificates this process
+// has obtained on-demand for it, so it can refuse once that host's
+// MaxCerts is reached -- independently of every other host's count,
+// since one host's on-demand traffic shouldn't be able to exhaust
+// another host's budget.
+var certsIssued = struct {
+	sync.Mutex
+	n map[string]int
+}{n: make(map[string]int)}
+
+var errOnDemandCapReached = errors.New("tls: on-demand certificate cap reached")
+
+// GetCertificateOnDemand is a tls.Config.GetCertificate implementation
+// for on-demand TLS: it serves a cached certificate for clientHello's
+// SNI name if one is in memory, loads one from storage if one's on
+// disk from a previous run, or else obtains a new one from the CA
+// server on leEmail's account, synchronously, subject to
+// onDemandTimeout and MaxCerts.
+func GetCertificateOnDemand(leEmail string, clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := clientHello.ServerName
+	if name == "" {
+		return nil, errors.New("tls: no SNI name in ClientHello")
+	}
+
+	if cert, ok := cachedCertificate(name); ok {
+		return cert, nil
+	}
+
+	if cert, ok, err := certFromStorage(name); err != nil {
+		return nil, err
+	} else if ok {
+		cacheCertificate(name, cert)
+		return cert, nil
+	}
+
+	return obtainOnDemand(leEmail, name)
+}
+
+func cachedCertificate(name string) (*tls.Certificate, bool) {
+	onDemandCache.RLock()
+	defer onDemandCache.RUnlock()
+	cert, ok := onDemandCache.certs[name]
+	return cert, ok
+}
+
+func cacheCertificate(name string, cert *tls.Certificate) {
+	onDemandCache.Lock()
+	onDemandCache.certs[name] = cert
+	onDemandCache.Unlock()
+}
+
+func certFromStorage(name string) (*tls.Certificate, bool, error) {
+	if !storage.SiteExists(name) {
+		return nil, false, nil
+	}
+	certBytes, keyBytes, err := storage.LoadSite(name)
+	if err != nil {
+		return nil, false, err
+	}
+	cert, err := certificateWithStaple(name, certBytes, keyBytes)
+	if err != nil {
+		return nil, false, err
+	}
+	return cert, true, nil
+}
+
+// obtainOnDemand obtains, caches, and persists a new certificate for
+// name, as long as on-demand TLS is enabled for it and doing so
+// wouldn't exceed its MaxCerts.
+func obtainOnDemand(leEmail, name string) (*tls.Certificate, error) {
+	maxCerts := optionsFor(name).MaxCerts
+	if !reserveSlot(name, maxCerts) {
+		return nil, errOnDemandCapReached
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), onDemandTimeout)
+	defer cancel()
+
+	type result struct {
+		cert acme.CertificateResource
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		client, err := newClient(clientKey{email: leEmail, opts: optionsFor(name)})
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		certs, err := client.ObtainCertificates([]string{name})
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		if len(certs) == 0 {
+			done <- result{err: errors.New("tls: CA returned no certificate for " + name)}
+			return
+		}
+		done <- result{cert: certs[0]}
+	}()
+
+	select {
+	case <-ctx.Done():
+		releaseSlot(name)
+		return nil, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			releaseSlot(name)
+			return nil, res.err
+		}
+		if err := storage.Lock(name); err != nil {
+			releaseSlot(name)
+			return nil, err
+		}
+		err := saveCertAndKey(res.cert)
+		storage.Unlock(name)
+		if err != nil {
+			releaseSlot(name)
+			return nil, err
+		}
+		cert, err := certificateWithStaple(name, res.cert.Certificate, res.cert.PrivateKey)
+		if err != nil {
+			releaseSlot(name)
+			return nil, err
+		}
+		log.Printf("[INFO] Obtained certificate on-demand for %s", name)
+		cacheCertificate(name, cert)
+		return cert, nil
+	}
+}
+
+// reserveSlot reserves a slot to issue one certificate for name
+// against maxCerts, the effective MaxCerts for name. Each host's count
+// is tracked and compared independently, so one host's on-demand
+// traffic can't exhaust another host's cap. On-demand TLS is disabled
+// entirely when maxCerts <= 0 -- it's not "unlimited".
+func reserveSlot(name string, maxCerts int) bool {
+	if maxCerts <= 0 {
+		return false
+	}
+	certsIssued.Lock()
+	defer certsIssued.Unlock()
+	if certsIssued.n[name] >= maxCerts {
+		return false
+	}
+	certsIssued.n[name]++
+	return true
+}
+
+func releaseSlot(name string) {
+	certsIssued.Lock()
+	certsIssued.n[name]--
+	certsIssued.Unlock()
+}
@@ -0,0 +1,43 @@
+package letsencrypt
+
+import "testing"
+
+func TestReserveSlotPerHost(t *testing.T) {
+	certsIssued.Lock()
+	certsIssued.n = make(map[string]int)
+	certsIssued.Unlock()
+
+	if !reserveSlot("a.example.com", 2) {
+		t.Fatal("expected first reservation for a.example.com to succeed")
+	}
+
+	// b.example.com has its own, much larger cap; exhausting it should
+	// have no effect on a.example.com's cap.
+	for i := 0; i < 50; i++ {
+		if !reserveSlot("b.example.com", 100) {
+			t.Fatalf("expected reservation %d for b.example.com to succeed", i)
+		}
+	}
+
+	if !reserveSlot("a.example.com", 2) {
+		t.Fatal("expected second reservation for a.example.com to still succeed")
+	}
+	if reserveSlot("a.example.com", 2) {
+		t.Fatal("expected a.example.com's cap of 2 to now be exhausted")
+	}
+
+	releaseSlot("a.example.com")
+	if !reserveSlot("a.example.com", 2) {
+		t.Fatal("expected a.example.com to have a free slot again after releaseSlot")
+	}
+}
+
+func TestReserveSlotDisabledWhenMaxCertsNotPositive(t *testing.T) {
+	certsIssued.Lock()
+	certsIssued.n = make(map[string]int)
+	certsIssued.Unlock()
+
+	if reserveSlot("c.example.com", 0) {
+		t.Fatal("expected MaxCerts <= 0 to disable on-demand issuance")
+	}
+}
@@ -0,0 +1,377 @@
+package letsencrypt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage describes how ACME user accounts, site certificates, and
+// renewal bookkeeping are persisted. The zero-value behavior Caddy has
+// always had -- everything lives under the local Caddy home directory
+// -- is provided by fileStorage below. Implementing Storage against a
+// shared backend (Consul, etcd, S3, ...) lets a fleet of Caddy
+// instances fronting the same hosts draw from one pool of certificates
+// instead of each instance issuing and renewing independently.
+//
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// StoreUser persists a user's ACME registration (JSON-encoded) and
+	// private key (PEM-encoded) under email.
+	StoreUser(email string, reg, key []byte) error
+
+	// LoadUser loads back what StoreUser wrote. The returned error
+	// satisfies os.IsNotExist if no user is on file for email.
+	LoadUser(email string) (reg, key []byte, err error)
+
+	// MostRecentUserEmail returns the email address most recently
+	// passed to StoreUser, or "" if no user has been stored yet. It is
+	// used to guess which account to use when the Caddyfile and
+	// command line don't say.
+	MostRecentUserEmail() string
+
+	// StoreSite persists a site's certificate and private key.
+	StoreSite(domain string, cert, key []byte) error
+
+	// LoadSite loads back what StoreSite wrote. The returned error
+	// satisfies os.IsNotExist if nothing is on file for domain.
+	LoadSite(domain string) (cert, key []byte, err error)
+
+	// SiteExists reports whether a certificate and key are on file
+	// for domain.
+	SiteExists(domain string) bool
+
+	// StoreMeta persists the JSON certificate metadata for domain.
+	StoreMeta(domain string, meta []byte) error
+
+	// LoadMeta loads back what StoreMeta wrote.
+	LoadMeta(domain string) (meta []byte, err error)
+
+	// StoreOCSPStaple caches a DER-encoded OCSP response for domain's
+	// certificate, to be sent ("stapled") during the TLS handshake.
+	StoreOCSPStaple(domain string, staple []byte) error
+
+	// LoadOCSPStaple loads back what StoreOCSPStaple wrote. The
+	// returned error satisfies os.IsNotExist if nothing is cached for
+	// domain.
+	LoadOCSPStaple(domain string) (staple []byte, err error)
+
+	// ReadRenewTimer returns the last time a renewal pass ran, or the
+	// zero Time if a pass has never run.
+	ReadRenewTimer() (time.Time, error)
+
+	// WriteRenewTimer records that a renewal pass ran at t.
+	WriteRenewTimer(t time.Time) error
+
+	// Lock blocks until it obtains an exclusive, named lock, so that
+	// only one Caddy instance sharing this storage acts on name
+	// (typically a domain) at a time -- this is what lets several
+	// instances share one storage without racing to issue or renew
+	// the same certificate. Unlock releases a lock obtained this way.
+	Lock(name string) error
+	Unlock(name string) error
+}
+
+// StorageConstructor creates a Storage from a backend-specific config
+// string, e.g. a directory for the file backend or an agent address
+// for the consul backend.
+type StorageConstructor func(config string) (Storage, error)
+
+// storageBackends holds the registered storage backends, keyed by the
+// name passed to SetStorage to select them.
+var storageBackends = make(map[string]StorageConstructor)
+
+// RegisterStorage makes a storage backend named name available to
+// SetStorage. It is meant to be called from init functions, including
+// those of plugins outside this package.
+func RegisterStorage(name string, constructor StorageConstructor) {
+	storageBackends[name] = constructor
+}
+
+func init() {
+	RegisterStorage("file", func(config string) (Storage, error) {
+		return newFileStorage(config)
+	})
+	RegisterStorage("consul", func(config string) (Storage, error) {
+		return newConsulStorage(config)
+	})
+}
+
+// storage is the Storage backend currently in effect. It defaults to
+// the local file system. Calling SetStorage before Activate runs swaps
+// it out; no Caddyfile directive calls SetStorage.
+var storage Storage = defaultFileStorage()
+
+// SetStorage replaces the package's active storage backend. name must
+// have been registered with RegisterStorage; config is passed through
+// to its constructor unmodified.
+func SetStorage(name, config string) error {
+	constructor, ok := storageBackends[name]
+	if !ok {
+		return fmt.Errorf("unknown storage backend %q", name)
+	}
+	s, err := constructor(config)
+	if err != nil {
+		return err
+	}
+	storage = s
+	return nil
+}
+
+// filePather is implemented by Storage backends that keep their files
+// on local disk, letting callers hand a path straight to things like
+// tls.LoadX509KeyPair instead of loading the bytes into memory
+// themselves. Backends without a local file (e.g. consulStorage)
+// don't implement this.
+type filePather interface {
+	SitePaths(domain string) (certFile, keyFile string)
+}
+
+// fileStorage is the original, default Storage: everything lives
+// under a directory on the local file system, laid out the same way
+// Caddy always has:
+//
+//	<dir>/users/<email>/registration
+//	<dir>/users/<email>/<email>.key
+//	<dir>/sites/<domain>/<domain>.crt
+//	<dir>/sites/<domain>/<domain>.key
+//	<dir>/sites/<domain>/<domain>.json
+//	<dir>/renew.timer
+//
+// Locking is implemented with exclusive lock files, since that's the
+// only primitive the local file system gives us for coordinating with
+// other processes.
+type fileStorage struct {
+	dir string
+
+	mu    sync.Mutex
+	locks map[string]*os.File
+}
+
+func newFileStorage(dir string) (Storage, error) {
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".caddy")
+	}
+	return &fileStorage{dir: dir, locks: make(map[string]*os.File)}, nil
+}
+
+func defaultFileStorage() Storage {
+	s, _ := newFileStorage("")
+	return s
+}
+
+func (s *fileStorage) users() string { return filepath.Join(s.dir, "users") }
+func (s *fileStorage) user(email string) string {
+	if email == "" {
+		email = "default"
+	}
+	return filepath.Join(s.users(), strings.ToLower(email))
+}
+func (s *fileStorage) userRegFile(email string) string {
+	return filepath.Join(s.user(email), "registration")
+}
+func (s *fileStorage) userKeyFile(email string) string {
+	if email == "" {
+		email = "default"
+	}
+	return filepath.Join(s.user(email), email+".key")
+}
+
+func (s *fileStorage) sites() string             { return filepath.Join(s.dir, "sites") }
+func (s *fileStorage) site(domain string) string { return filepath.Join(s.sites(), domain) }
+func (s *fileStorage) siteCertFile(domain string) string {
+	return filepath.Join(s.site(domain), domain+".crt")
+}
+func (s *fileStorage) siteKeyFile(domain string) string {
+	return filepath.Join(s.site(domain), domain+".key")
+}
+func (s *fileStorage) siteMetaFile(domain string) string {
+	return filepath.Join(s.site(domain), domain+".json")
+}
+func (s *fileStorage) siteOCSPFile(domain string) string {
+	return filepath.Join(s.site(domain), domain+".ocsp")
+}
+
+func (s *fileStorage) renewTimerFile() string { return filepath.Join(s.dir, "renew.timer") }
+
+func (s *fileStorage) SitePaths(domain string) (certFile, keyFile string) {
+	return s.siteCertFile(domain), s.siteKeyFile(domain)
+}
+
+func (s *fileStorage) StoreUser(email string, reg, key []byte) error {
+	err := os.MkdirAll(s.user(email), 0700)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.userKeyFile(email), key, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.userRegFile(email), reg, 0600)
+}
+
+func (s *fileStorage) LoadUser(email string) (reg, key []byte, err error) {
+	reg, err = ioutil.ReadFile(s.userRegFile(email))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = ioutil.ReadFile(s.userKeyFile(email))
+	if err != nil {
+		return nil, nil, err
+	}
+	return reg, key, nil
+}
+
+func (s *fileStorage) MostRecentUserEmail() string {
+	userDirs, err := ioutil.ReadDir(s.users())
+	if err != nil {
+		return ""
+	}
+	var mostRecent os.FileInfo
+	for _, dir := range userDirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if mostRecent == nil || dir.ModTime().After(mostRecent.ModTime()) {
+			mostRecent = dir
+		}
+	}
+	if mostRecent == nil {
+		return ""
+	}
+	return mostRecent.Name()
+}
+
+func (s *fileStorage) StoreSite(domain string, cert, key []byte) error {
+	err := os.MkdirAll(s.site(domain), 0700)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.siteCertFile(domain), cert, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.siteKeyFile(domain), key, 0600)
+}
+
+func (s *fileStorage) LoadSite(domain string) (cert, key []byte, err error) {
+	cert, err = ioutil.ReadFile(s.siteCertFile(domain))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = ioutil.ReadFile(s.siteKeyFile(domain))
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func (s *fileStorage) SiteExists(domain string) bool {
+	_, err := os.Stat(s.siteCertFile(domain))
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(s.siteKeyFile(domain))
+	return err == nil
+}
+
+func (s *fileStorage) StoreMeta(domain string, meta []byte) error {
+	err := os.MkdirAll(s.site(domain), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.siteMetaFile(domain), meta, 0600)
+}
+
+func (s *fileStorage) LoadMeta(domain string) (meta []byte, err error) {
+	return ioutil.ReadFile(s.siteMetaFile(domain))
+}
+
+func (s *fileStorage) StoreOCSPStaple(domain string, staple []byte) error {
+	err := os.MkdirAll(s.site(domain), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.siteOCSPFile(domain), staple, 0600)
+}
+
+func (s *fileStorage) LoadOCSPStaple(domain string) (staple []byte, err error) {
+	return ioutil.ReadFile(s.siteOCSPFile(domain))
+}
+
+func (s *fileStorage) ReadRenewTimer() (time.Time, error) {
+	timeBytes, err := ioutil.ReadFile(s.renewTimerFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, string(timeBytes))
+}
+
+func (s *fileStorage) WriteRenewTimer(t time.Time) error {
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.renewTimerFile(), []byte(t.UTC().Format(time.RFC3339)), 0600)
+}
+
+// lockStaleAfter bounds how long a lock file may sit untouched before
+// Lock assumes its holder crashed (or was killed) without calling
+// Unlock, and removes it rather than waiting on it forever. It's set
+// well above how long a real ACME issuance or renewal round trip
+// should ever take.
+const lockStaleAfter = 2 * time.Minute
+
+// Lock implements a simple, polled, file-based mutex: other processes
+// (and other goroutines, via mu) block until the holder removes the
+// lock file by calling Unlock. Since a crash leaves the lock file
+// behind with nobody left to remove it, every poll also checks the
+// file's age and steals it once it's older than lockStaleAfter.
+func (s *fileStorage) Lock(name string) error {
+	lockFile := filepath.Join(s.dir, "locks", name+".lock")
+	err := os.MkdirAll(filepath.Dir(lockFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	for {
+		s.mu.Lock()
+		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			s.locks[name] = f
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+		if !os.IsExist(err) {
+			return err
+		}
+
+		if info, statErr := os.Stat(lockFile); statErr == nil && time.Since(info.ModTime()) > lockStaleAfter {
+			log.Printf("[WARN] Removing stale lock %s (untouched for over %s)", lockFile, lockStaleAfter)
+			os.Remove(lockFile) // best-effort; if another process wins the race, the next OpenFile just fails again
+			continue
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func (s *fileStorage) Unlock(name string) error {
+	s.mu.Lock()
+	f, ok := s.locks[name]
+	delete(s.locks, name)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	lockFile := f.Name()
+	f.Close()
+	return os.Remove(lockFile)
+}
@@ -0,0 +1,165 @@
+package letsencrypt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestFileStorage(t *testing.T) *fileStorage {
+	dir, err := ioutil.TempDir("", "letsencrypt_storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newFileStorage(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s.(*fileStorage)
+}
+
+func TestFileStorageUserRoundTrip(t *testing.T) {
+	s := newTestFileStorage(t)
+
+	err := s.StoreUser("user@example.com", []byte("registration"), []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, key, err := s.LoadUser("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reg) != "registration" || string(key) != "key" {
+		t.Fatalf("got reg=%q key=%q, want reg=%q key=%q", reg, key, "registration", "key")
+	}
+
+	if got := s.MostRecentUserEmail(); got != "user@example.com" {
+		t.Fatalf("MostRecentUserEmail() = %q, want %q", got, "user@example.com")
+	}
+
+	if _, _, err := s.LoadUser("nobody@example.com"); !os.IsNotExist(err) {
+		t.Fatalf("LoadUser for missing user: err = %v, want os.IsNotExist", err)
+	}
+}
+
+func TestFileStorageSiteRoundTrip(t *testing.T) {
+	s := newTestFileStorage(t)
+
+	if s.SiteExists("example.com") {
+		t.Fatal("SiteExists true before StoreSite")
+	}
+
+	err := s.StoreSite("example.com", []byte("cert"), []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.SiteExists("example.com") {
+		t.Fatal("SiteExists false after StoreSite")
+	}
+
+	cert, key, err := s.LoadSite("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert) != "cert" || string(key) != "key" {
+		t.Fatalf("got cert=%q key=%q, want cert=%q key=%q", cert, key, "cert", "key")
+	}
+
+	err = s.StoreMeta("example.com", []byte("meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.LoadMeta("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(meta) != "meta" {
+		t.Fatalf("LoadMeta() = %q, want %q", meta, "meta")
+	}
+
+	err = s.StoreOCSPStaple("example.com", []byte("staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	staple, err := s.LoadOCSPStaple("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(staple) != "staple" {
+		t.Fatalf("LoadOCSPStaple() = %q, want %q", staple, "staple")
+	}
+}
+
+func TestFileStorageRenewTimer(t *testing.T) {
+	s := newTestFileStorage(t)
+
+	zero, err := s.ReadRenewTimer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !zero.IsZero() {
+		t.Fatalf("ReadRenewTimer() before any write = %v, want zero time", zero)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := s.WriteRenewTimer(now); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.ReadRenewTimer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(now) {
+		t.Fatalf("ReadRenewTimer() = %v, want %v", got, now)
+	}
+}
+
+func TestFileStorageLockUnlock(t *testing.T) {
+	s := newTestFileStorage(t)
+
+	if err := s.Lock("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unlock("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Locking again after Unlock must not block.
+	if err := s.Lock("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unlock("example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStorageLockStealsStaleLock(t *testing.T) {
+	s := newTestFileStorage(t)
+
+	if err := s.Lock("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash: forget about the held lock (so Unlock from this
+	// goroutine can't clean it up) and backdate its mtime past
+	// lockStaleAfter so the next Lock call considers it abandoned.
+	lockFile := s.locks["example.com"].Name()
+	delete(s.locks, "example.com")
+	old := time.Now().Add(-2 * lockStaleAfter)
+	if err := os.Chtimes(lockFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Lock("example.com") }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock did not steal a stale lock file")
+	}
+}
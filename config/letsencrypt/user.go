@@ -2,13 +2,11 @@ package letsencrypt
 
 import (
 	"bufio"
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"strings"
 
@@ -20,10 +18,26 @@ import (
 type User struct {
 	Email        string
 	Registration *acme.RegistrationResource
-	KeyFile      string
-	key          *rsa.PrivateKey
+	key          crypto.Signer
+
+	// EABKeyID and EABHMACKey are this account's External Account
+	// Binding credentials, if the CA required them at registration.
+	// They're captured from the host's HostOptions (which default to
+	// EABKeyID/EABHMACKey below) at the time the account is created, so
+	// they travel with it in storage.
+	EABKeyID   string `json:",omitempty"`
+	EABHMACKey string `json:",omitempty"`
 }
 
+// EABKeyID and EABHMACKey supply External Account Binding
+// credentials for ACME CAs (typically commercial ones) that require
+// a pre-existing account relationship in order to register. No
+// Caddyfile directive sets these.
+var (
+	EABKeyID   string
+	EABHMACKey string
+)
+
 // GetEmail gets u's email.
 func (u User) GetEmail() string {
 	return u.Email
@@ -35,36 +49,34 @@ func (u User) GetRegistration() *acme.RegistrationResource {
 }
 
 // GetPrivateKey gets u's private key.
-func (u User) GetPrivateKey() *rsa.PrivateKey {
+func (u User) GetPrivateKey() crypto.Signer {
 	return u.key
 }
 
-// getUser loads the user with the given email from disk.
-// If the user does not exist, it will create a new one,
-// but it does NOT save new users to the disk or register
-// them via ACME.
-func getUser(email string) (User, error) {
+// getUser loads the user with the given email from storage.
+// If the user does not exist, it will create a new one per opts,
+// but it does NOT save new users to storage or register them via
+// ACME.
+func getUser(email string, opts HostOptions) (User, error) {
 	var user User
 
-	// open user file
-	regFile, err := os.Open(storage.UserRegFile(email))
+	regBytes, keyBytes, err := storage.LoadUser(email)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// create a new user
-			return newUser(email)
+			return newUser(email, opts)
 		}
 		return user, err
 	}
-	defer regFile.Close()
 
 	// load user information
-	err = json.NewDecoder(regFile).Decode(&user)
+	err = json.Unmarshal(regBytes, &user)
 	if err != nil {
 		return user, err
 	}
 
 	// load their private key
-	user.key, err = loadRSAPrivateKey(user.KeyFile)
+	user.key, err = loadPrivateKey(keyBytes)
 	if err != nil {
 		return user, err
 	}
@@ -73,38 +85,29 @@ func getUser(email string) (User, error) {
 }
 
 // saveUser persists a user's key and account registration
-// to the file system. It does NOT register the user via ACME.
+// to storage. It does NOT register the user via ACME.
 func saveUser(user User) error {
-	// make user account folder
-	err := os.MkdirAll(storage.User(user.Email), 0700)
+	keyBytes, err := savePrivateKey(user.key)
 	if err != nil {
 		return err
 	}
 
-	// save private key file
-	user.KeyFile = storage.UserKeyFile(user.Email)
-	err = saveRSAPrivateKey(user.key, user.KeyFile)
+	regBytes, err := json.MarshalIndent(&user, "", "\t")
 	if err != nil {
 		return err
 	}
 
-	// save registration file
-	jsonBytes, err := json.MarshalIndent(&user, "", "\t")
-	if err != nil {
-		return err
-	}
-
-	return ioutil.WriteFile(storage.UserRegFile(user.Email), jsonBytes, 0600)
+	return storage.StoreUser(user.Email, regBytes, keyBytes)
 }
 
-// newUser creates a new User for the given email address
-// with a new private key. This function does NOT save the
-// user to disk or register it via ACME. If you want to use
-// a user account that might already exist, call getUser
-// instead.
-func newUser(email string) (User, error) {
-	user := User{Email: email}
-	privateKey, err := rsa.GenerateKey(rand.Reader, rsaKeySizeToUse)
+// newUser creates a new User for the given email address with a new
+// private key and EAB credentials, both taken from opts. This
+// function does NOT save the user to disk or register it via ACME.
+// If you want to use a user account that might already exist, call
+// getUser instead.
+func newUser(email string, opts HostOptions) (User, error) {
+	user := User{Email: email, EABKeyID: opts.EABKeyID, EABHMACKey: opts.EABHMACKey}
+	privateKey, err := generateKey(opts.KeyType)
 	if err != nil {
 		return user, errors.New("error generating private key: " + err.Error())
 	}
@@ -123,23 +126,8 @@ func getEmail(cfg server.Config) string {
 		leEmail = DefaultEmail
 	}
 	if leEmail == "" {
-		// Then try to get most recent user email ~/.caddy/users file
-		// TODO: Probably better to open the user's json file and read the email out of there...
-		userDirs, err := ioutil.ReadDir(storage.Users())
-		if err == nil {
-			var mostRecent os.FileInfo
-			for _, dir := range userDirs {
-				if !dir.IsDir() {
-					continue
-				}
-				if mostRecent == nil || dir.ModTime().After(mostRecent.ModTime()) {
-					mostRecent = dir
-				}
-			}
-			if mostRecent != nil {
-				leEmail = mostRecent.Name()
-			}
-		}
+		// Then try the most recently stored user account
+		leEmail = storage.MostRecentUserEmail()
 	}
 	if leEmail == "" {
 		// Alas, we must bother the user and ask for an email address
@@ -158,4 +146,4 @@ func getEmail(cfg server.Config) string {
 
 // stdin is used to read the user's input if prompted;
 // this is changed by tests during tests.
-var stdin = io.ReadWriter(os.Stdin)
\ No newline at end of file
+var stdin = io.ReadWriter(os.Stdin)